@@ -0,0 +1,42 @@
+package config
+
+import (
+	"net"
+)
+
+type DhcpV4Options struct {
+	Handshake         bool
+	DhcpInfo          bool
+	EthernetBroadcast bool
+	DhcpBroadcast     bool
+	DhcpRelease       bool
+	DhcpDecline       bool
+
+	Arp           bool
+	ArpFakeMAC    bool
+	Bind          bool
+	InstallRoutes bool
+
+	DhcpRelay           bool
+	RelaySourceIP       net.IP
+	RelayGatewayIP      net.IP
+	RelayTargetServerIP net.IP
+	TargetPort          int
+
+	AdditionalDhcpOptions []string
+
+	RequestsPerSecond int
+	MaxLifetime       int
+
+	DiscoverTimeoutSeconds int
+	DiscoverMaxAttempts    int
+
+	MacCount      int
+	SpecifiedMacs []string
+
+	StatsRate int
+}
+
+func (o *DhcpV4Options) HammerType() string {
+	return "dhcpv4"
+}
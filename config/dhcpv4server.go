@@ -0,0 +1,26 @@
+package config
+
+import (
+	"net"
+)
+
+type DhcpV4ServerOptions struct {
+	EthernetBroadcast bool
+
+	PoolCIDR         string
+	SubnetMask       net.IP
+	Router           net.IP
+	DNSServers       []net.IP
+	LeaseSeconds     int
+	ServerIdentifier net.IP
+
+	OfferTimeoutSeconds int
+
+	TargetPort int
+
+	StatsRate int
+}
+
+func (o *DhcpV4ServerOptions) HammerType() string {
+	return "dhcpv4-server"
+}
@@ -0,0 +1,5 @@
+package config
+
+type HammerConfig interface {
+	HammerType() string
+}
@@ -5,32 +5,69 @@ import (
 	"dhammer/message"
 	"dhammer/socketeer"
 	"dhammer/stats"
+	"dhammer/xid"
+	"encoding/binary"
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/vishvananda/netlink"
 	"net"
+	"sync"
 	"time"
 )
 
+// renewInterval is how often the renewal goroutine walks acquiredIPs looking
+// for leases that have crossed T1, T2 or their expiry, and pending DISCOVERs
+// for ones that have timed out.
+const renewInterval = 1 * time.Second
+
+const (
+	defaultDiscoverTimeout     = 5 * time.Second
+	defaultDiscoverMaxAttempts = 4
+)
+
 type LeaseDhcpV4 struct {
-	Packet   gopacket.Packet
-	LinkAddr *netlink.Addr
-	Acquired time.Time
-	HwAddr   net.HardwareAddr
+	Packet     gopacket.Packet
+	LinkAddr   *netlink.Addr
+	Route      *netlink.Route
+	Acquired   time.Time
+	HwAddr     net.HardwareAddr
+	IP         net.IP
+	Xid        uint32
+	LeaseTime  time.Duration
+	T1         time.Time
+	T2         time.Time
+	Expiry     time.Time
+	ServerID   net.IP
+	SubnetMask net.IP
+	Router     net.IP
+	DNS        []net.IP
+	Renewed    bool
+	Rebound    bool
 }
 
 type HandlerDhcpV4 struct {
-	options      *config.DhcpV4Options
-	socketeer    *socketeer.RawSocketeer
-	iface        *net.Interface
-	link         netlink.Link
-	acquiredIPs  map[string]*LeaseDhcpV4
-	addLog       func(string) bool
-	addError     func(error) bool
-	sendPayload  func([]byte) bool
-	addStat      func(stats.StatValue) bool
-	inputChannel chan message.Message
-	doneChannel  chan struct{}
+	options          *config.DhcpV4Options
+	socketeer        *socketeer.RawSocketeer
+	iface            *net.Interface
+	link             netlink.Link
+	acquiredIPs      map[string]*LeaseDhcpV4
+	acquiredIPsMutex sync.Mutex
+	addLog           func(string) bool
+	addError         func(error) bool
+	sendPayload      func([]byte) bool
+	addStat          func(stats.StatValue) bool
+	inputChannel     chan message.Message
+	doneChannel      chan struct{}
+	renewStopChannel chan struct{}
+	renewDoneChannel chan struct{}
+
+	xidGen           *xid.Generator
+	discoverTracker  *xid.Tracker
+	discoverTimeout  time.Duration
+	discoverAttempts int
+
+	observers []LeaseObserver
 }
 
 func init() {
@@ -42,21 +79,51 @@ func init() {
 func NewDhcpV4(hip HandlerInitParams) Handler {
 
 	h := HandlerDhcpV4{
-		options:      hip.options.(*config.DhcpV4Options),
-		socketeer:    hip.socketeer,
-		iface:        hip.socketeer.IfInfo,
-		acquiredIPs:  make(map[string]*LeaseDhcpV4),
-		addLog:       hip.logFunc,
-		addError:     hip.errFunc,
-		sendPayload:  hip.socketeer.AddPayload,
-		addStat:      hip.statFunc,
-		inputChannel: make(chan message.Message, 10000),
-		doneChannel:  make(chan struct{}),
+		options:         hip.options.(*config.DhcpV4Options),
+		socketeer:       hip.socketeer,
+		iface:           hip.socketeer.IfInfo,
+		acquiredIPs:     make(map[string]*LeaseDhcpV4),
+		addLog:          hip.logFunc,
+		addError:        hip.errFunc,
+		sendPayload:     hip.socketeer.AddPayload,
+		addStat:         hip.statFunc,
+		inputChannel:    make(chan message.Message, 10000),
+		doneChannel:     make(chan struct{}),
+		xidGen:          xid.NewGenerator(hip.socketeer.IfInfo.HardwareAddr),
+		discoverTracker: xid.NewTracker(),
+		observers:       hip.observers,
+	}
+
+	h.renewStopChannel = make(chan struct{})
+	h.renewDoneChannel = make(chan struct{})
+
+	h.discoverTimeout = defaultDiscoverTimeout
+	if h.options.DiscoverTimeoutSeconds > 0 {
+		h.discoverTimeout = time.Duration(h.options.DiscoverTimeoutSeconds) * time.Second
+	}
+
+	h.discoverAttempts = defaultDiscoverMaxAttempts
+	if h.options.DiscoverMaxAttempts > 0 {
+		h.discoverAttempts = h.options.DiscoverMaxAttempts
 	}
 
 	return &h
 }
 
+// SendDiscover is the one true entry point for originating a new DHCPv4
+// transaction for hwAddr (called by the dhcpv4 generator for each client
+// MAC it drives): it allocates an RFC 2131 §4.1 transaction id, registers
+// the exchange with discoverTracker so the renewal loop can re-emit the
+// DISCOVER if no OFFER shows up in time, and sends the packet.
+func (h *HandlerDhcpV4) SendDiscover(hwAddr net.HardwareAddr) bool {
+
+	newXid := h.xidGen.Next()
+
+	h.discoverTracker.Track(newXid, hwAddr, h.discoverTimeout, h.discoverAttempts)
+
+	return h.sendDiscover(hwAddr, newXid)
+}
+
 func (h *HandlerDhcpV4) ReceiveMessage(msg message.Message) bool {
 
 	select {
@@ -74,14 +141,28 @@ func (h *HandlerDhcpV4) Init() error {
 	var err error = nil
 
 	h.link, err = netlink.LinkByName("lo")
+	if err != nil {
+		return err
+	}
 
-	return err
+	go h.renewLoop()
+
+	return nil
 }
 
 func (h *HandlerDhcpV4) DeInit() error {
 
+	h.acquiredIPsMutex.Lock()
+	defer h.acquiredIPsMutex.Unlock()
+
 	if h.options.Bind {
 		for _, lease := range h.acquiredIPs {
+			if lease.Route != nil {
+				if err := netlink.RouteDel(lease.Route); err != nil {
+					h.addError(err)
+				}
+			}
+
 			if err := netlink.AddrDel(h.link, lease.LinkAddr); err != nil {
 				h.addError(err)
 			}
@@ -94,9 +175,234 @@ func (h *HandlerDhcpV4) DeInit() error {
 func (h *HandlerDhcpV4) Stop() error {
 	close(h.inputChannel)
 	<-h.doneChannel
+
+	close(h.renewStopChannel)
+	<-h.renewDoneChannel
+
 	return nil
 }
 
+// renewLoop walks acquiredIPs on a ticker, issuing the RFC 2131 §4.4.5
+// RENEWING/REBINDING DHCPREQUESTs as leases cross T1/T2 and dropping them
+// once they expire. The same tick also drives DISCOVER retransmission for
+// transactions that haven't seen an OFFER in time.
+func (h *HandlerDhcpV4) renewLoop() {
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.renewStopChannel:
+			h.renewDoneChannel <- struct{}{}
+			return
+		case now := <-ticker.C:
+			h.renewLeases(now)
+			h.retryDiscovers(now)
+		}
+	}
+}
+
+// retryDiscovers re-emits the DISCOVER for any tracked transaction whose
+// deadline has passed, up to its configured attempt limit, and gives up on
+// the rest.
+func (h *HandlerDhcpV4) retryDiscovers(now time.Time) {
+
+	retry, abandoned := h.discoverTracker.Expired(now)
+
+	for _, txn := range retry {
+		h.addStat(stats.DiscoverTimeoutStat)
+		h.sendDiscover(txn.HwAddr, txn.Xid)
+	}
+
+	for _, txn := range abandoned {
+		h.addStat(stats.DiscoverTimeoutStat)
+		h.addError(fmt.Errorf("dhcpv4: giving up on DISCOVER xid %d for %s after %d attempts", txn.Xid, txn.HwAddr, txn.Attempts))
+	}
+}
+
+// sendDiscover re-emits a broadcast DHCPDISCOVER for hwAddr/xidVal using the
+// same gopacket layer pipeline as the rest of the handler.
+func (h *HandlerDhcpV4) sendDiscover(hwAddr net.HardwareAddr, xidVal uint32) bool {
+
+	socketeerOptions := h.socketeer.Options()
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	if !h.options.EthernetBroadcast {
+		ethernetLayer.DstMAC = socketeerOptions.GatewayMAC
+	}
+
+	ipLayer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: 17,
+		SrcIP:    net.IPv4(0, 0, 0, 0),
+		DstIP:    net.IPv4(255, 255, 255, 255),
+	}
+
+	udpLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(68),
+		DstPort: layers.UDPPort(h.options.TargetPort),
+	}
+
+	dhcpLayer := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Flags:        0x8000,
+		Xid:          xidVal,
+		ClientHWAddr: hwAddr,
+	}
+
+	if !h.options.DhcpBroadcast {
+		dhcpLayer.Flags = 0x0
+	}
+
+	if h.options.DhcpRelay {
+		ipLayer.SrcIP = h.options.RelaySourceIP
+		ipLayer.DstIP = h.options.RelayTargetServerIP
+		ethernetLayer.DstMAC = socketeerOptions.GatewayMAC
+		dhcpLayer.RelayAgentIP = h.options.RelayGatewayIP
+		udpLayer.SrcPort = 67
+	}
+
+	dhcpLayer.Options = make(layers.DHCPOptions, 2)
+	dhcpLayer.Options[0] = layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeDiscover)})
+	dhcpLayer.Options[1] = layers.NewDHCPOption(layers.DHCPOptEnd, []byte{})
+
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	buf := gopacket.NewSerializeBuffer()
+
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ethernetLayer,
+		ipLayer,
+		udpLayer,
+		dhcpLayer,
+	); err != nil {
+		h.addError(err)
+		return false
+	}
+
+	return h.sendPayload(buf.Bytes())
+}
+
+func (h *HandlerDhcpV4) renewLeases(now time.Time) {
+
+	h.acquiredIPsMutex.Lock()
+	defer h.acquiredIPsMutex.Unlock()
+
+	for ipStr, lease := range h.acquiredIPs {
+
+		if lease.LeaseTime == 0 {
+			// No lease options were parsed out of the ACK (e.g. the server didn't send one); nothing to renew.
+			continue
+		}
+
+		switch {
+		case !now.Before(lease.Expiry):
+			h.addStat(stats.LeaseExpiredStat)
+
+			notifyObservers(h.observers, LeaseEvent{
+				Type:   LeaseExpired,
+				Time:   now,
+				Xid:    lease.Xid,
+				HwAddr: lease.HwAddr,
+				IP:     lease.IP,
+			})
+
+			if h.options.Bind && lease.LinkAddr != nil {
+				if err := netlink.AddrDel(h.link, lease.LinkAddr); err != nil {
+					h.addError(err)
+				}
+			}
+
+			delete(h.acquiredIPs, ipStr)
+
+		case !now.Before(lease.T2) && !lease.Rebound:
+			lease.Rebound = true
+
+			if h.sendRenewRequest(lease, true) {
+				h.addStat(stats.RebindSentStat)
+			}
+
+		case !now.Before(lease.T1) && !lease.Renewed:
+			lease.Renewed = true
+
+			if h.sendRenewRequest(lease, false) {
+				h.addStat(stats.RenewSentStat)
+			}
+		}
+	}
+}
+
+// sendRenewRequest builds and sends the DHCPREQUEST used to renew (unicast
+// to the recorded server) or rebind (broadcast, no server identifier) a
+// lease per RFC 2131 §4.4.5. It uses its own set of layers rather than the
+// ones held locally by Run(), since this runs on a separate goroutine.
+func (h *HandlerDhcpV4) sendRenewRequest(lease *LeaseDhcpV4, rebinding bool) bool {
+
+	socketeerOptions := h.socketeer.Options()
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		DstMAC:       socketeerOptions.GatewayMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	ipLayer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: 17,
+		SrcIP:    lease.IP,
+		DstIP:    lease.ServerID,
+	}
+
+	udpLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(68),
+		DstPort: layers.UDPPort(67),
+	}
+
+	if rebinding || lease.ServerID == nil {
+		ethernetLayer.DstMAC = layers.EthernetBroadcast
+		ipLayer.DstIP = net.IPv4bcast
+	}
+
+	dhcpLayer := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          lease.Xid,
+		ClientIP:     lease.IP,
+		ClientHWAddr: lease.HwAddr,
+	}
+
+	dhcpLayer.Options = make(layers.DHCPOptions, 2)
+	dhcpLayer.Options[0] = layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)})
+	dhcpLayer.Options[1] = layers.NewDHCPOption(layers.DHCPOptEnd, []byte{})
+
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	buf := gopacket.NewSerializeBuffer()
+
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ethernetLayer,
+		ipLayer,
+		udpLayer,
+		dhcpLayer,
+	); err != nil {
+		h.addError(err)
+		return false
+	}
+
+	return h.sendPayload(buf.Bytes())
+}
+
 func (h *HandlerDhcpV4) Run() {
 
 	var msg message.Message
@@ -178,6 +484,16 @@ func (h *HandlerDhcpV4) Run() {
 
 			h.addStat(stats.OfferReceivedStat)
 
+			h.discoverTracker.Resolve(dhcpReply.Xid)
+
+			notifyObservers(h.observers, LeaseEvent{
+				Type:   LeaseOffered,
+				Time:   time.Now(),
+				Xid:    dhcpReply.Xid,
+				HwAddr: dhcpReply.ClientHWAddr,
+				IP:     dhcpReply.YourClientIP,
+			})
+
 			if h.options.Handshake {
 
 				buf := gopacket.NewSerializeBuffer()
@@ -223,26 +539,102 @@ func (h *HandlerDhcpV4) Run() {
 
 				ipStr := dhcpReply.YourClientIP.String()
 
-				if _, found := h.acquiredIPs[ipStr]; !found {
+				h.acquiredIPsMutex.Lock()
+
+				if lease, found := h.acquiredIPs[ipStr]; found {
+
+					// A RENEWING/REBINDING DHCPREQUEST for a lease we already
+					// hold just got confirmed - refresh its deadlines instead
+					// of dropping the ACK, otherwise renewLeases would still
+					// tear the lease down at the original Expiry even though
+					// the server just extended it.
+					lease.Acquired = time.Now()
+					lease.Xid = dhcpReply.Xid
+					applyLeaseOptions(lease, replyOptions)
+					lease.Renewed = false
+					lease.Rebound = false
+
+					notifyObservers(h.observers, LeaseEvent{
+						Type:       LeaseAcknowledged,
+						Time:       lease.Acquired,
+						Xid:        lease.Xid,
+						HwAddr:     lease.HwAddr,
+						IP:         lease.IP,
+						ServerID:   lease.ServerID,
+						SubnetMask: lease.SubnetMask,
+						Router:     lease.Router,
+						DNS:        lease.DNS,
+						LeaseTime:  lease.LeaseTime,
+					})
+
+				} else {
 
-					h.acquiredIPs[ipStr] = &LeaseDhcpV4{
+					lease := &LeaseDhcpV4{
 						Packet:   msg.Packet,
 						Acquired: time.Now(),
 						HwAddr:   dhcpReply.ClientHWAddr,
+						IP:       dhcpReply.YourClientIP,
+						Xid:      dhcpReply.Xid,
 					}
 
+					applyLeaseOptions(lease, replyOptions)
+
+					h.acquiredIPs[ipStr] = lease
+
+					notifyObservers(h.observers, LeaseEvent{
+						Type:       LeaseAcknowledged,
+						Time:       lease.Acquired,
+						Xid:        lease.Xid,
+						HwAddr:     lease.HwAddr,
+						IP:         lease.IP,
+						ServerID:   lease.ServerID,
+						SubnetMask: lease.SubnetMask,
+						Router:     lease.Router,
+						DNS:        lease.DNS,
+						LeaseTime:  lease.LeaseTime,
+					})
+
 					if h.options.Bind {
 
-						// Need to fix the CIDR here...
-						if addr, err := netlink.ParseAddr(ipStr + "/32"); err != nil {
-							h.addError(err)
-						} else if err = netlink.AddrAdd(h.link, addr); err != nil {
-							h.addError(err)
-						} else {
-							h.acquiredIPs[ipStr].LinkAddr = addr
+						prefixLen := 32
+						maskValid := true
+
+						if lease.SubnetMask != nil {
+							ones, bits := net.IPMask(lease.SubnetMask.To4()).Size()
+							if bits == 0 {
+								h.addError(fmt.Errorf("dhcpv4: malformed subnet mask %s from server, not binding %s", lease.SubnetMask, ipStr))
+								maskValid = false
+							} else {
+								prefixLen = ones
+							}
+						}
+
+						if maskValid {
+							if addr, err := netlink.ParseAddr(fmt.Sprintf("%s/%d", ipStr, prefixLen)); err != nil {
+								h.addError(err)
+							} else if err = netlink.AddrAdd(h.link, addr); err != nil {
+								h.addError(err)
+							} else {
+								lease.LinkAddr = addr
+
+								if h.options.InstallRoutes && lease.Router != nil {
+									route := &netlink.Route{
+										LinkIndex: h.link.Attrs().Index,
+										Gw:        lease.Router,
+									}
+
+									if err := netlink.RouteAdd(route); err != nil {
+										h.addError(err)
+									} else {
+										lease.Route = route
+									}
+								}
+							}
 						}
 					}
 				}
+
+				h.acquiredIPsMutex.Unlock()
 			}
 
 			if h.options.DhcpRelease || h.options.DhcpInfo {
@@ -313,23 +705,89 @@ func (h *HandlerDhcpV4) Run() {
 						h.addStat(stats.InfoSentStat)
 					} else {
 						h.addStat(stats.ReleaseSentStat)
+
+						notifyObservers(h.observers, LeaseEvent{
+							Type:   LeaseReleased,
+							Time:   time.Now(),
+							Xid:    dhcpReply.Xid,
+							HwAddr: dhcpReply.ClientHWAddr,
+							IP:     dhcpReply.YourClientIP,
+						})
 					}
 				}
 			}
 
 		} else if dhcpReply.Options[0].Data[0] == (byte)(layers.DHCPMsgTypeNak) {
 			h.addStat(stats.NakReceivedStat)
+
+			notifyObservers(h.observers, LeaseEvent{
+				Type:   LeaseNacked,
+				Time:   time.Now(),
+				Xid:    dhcpReply.Xid,
+				HwAddr: dhcpReply.ClientHWAddr,
+			})
 		}
 	}
 
 	h.doneChannel <- struct{}{}
 }
 
+// applyLeaseOptions pulls the lease time (opt 51), T1 (opt 58), T2 (opt 59),
+// server identifier (opt 54), subnet mask (opt 1), router (opt 3) and DNS
+// servers (opt 6) out of a DHCPACK's options and stamps the renewal
+// deadlines onto lease, per RFC 2131 §4.4.5. T1/T2 default to 0.5/0.875 of
+// the lease time when the server doesn't send them explicitly.
+func applyLeaseOptions(lease *LeaseDhcpV4, replyOptions [256]layers.DHCPOption) {
+
+	if opt := replyOptions[layers.DHCPOptLeaseTime]; len(opt.Data) == 4 {
+		lease.LeaseTime = time.Duration(binary.BigEndian.Uint32(opt.Data)) * time.Second
+	}
+
+	t1 := time.Duration(float64(lease.LeaseTime) * 0.5)
+	t2 := time.Duration(float64(lease.LeaseTime) * 0.875)
+
+	if opt := replyOptions[layers.DHCPOptT1]; len(opt.Data) == 4 {
+		t1 = time.Duration(binary.BigEndian.Uint32(opt.Data)) * time.Second
+	}
+
+	if opt := replyOptions[layers.DHCPOptT2]; len(opt.Data) == 4 {
+		t2 = time.Duration(binary.BigEndian.Uint32(opt.Data)) * time.Second
+	}
+
+	lease.T1 = lease.Acquired.Add(t1)
+	lease.T2 = lease.Acquired.Add(t2)
+	lease.Expiry = lease.Acquired.Add(lease.LeaseTime)
+
+	if opt := replyOptions[layers.DHCPOptServerID]; len(opt.Data) == 4 {
+		lease.ServerID = net.IP(opt.Data)
+	}
+
+	if opt := replyOptions[layers.DHCPOptSubnetMask]; len(opt.Data) == 4 {
+		lease.SubnetMask = net.IP(opt.Data)
+	}
+
+	if opt := replyOptions[layers.DHCPOptRouter]; len(opt.Data) >= 4 {
+		lease.Router = net.IP(opt.Data[0:4])
+	}
+
+	if opt := replyOptions[layers.DHCPOptDNS]; len(opt.Data) >= 4 {
+		lease.DNS = nil
+		for i := 0; i+4 <= len(opt.Data); i += 4 {
+			lease.DNS = append(lease.DNS, net.IP(opt.Data[i:i+4]))
+		}
+	}
+}
+
 func (h *HandlerDhcpV4) handleARP(msg message.Message) {
 	arpRequest := msg.Packet.Layer(layers.LayerTypeARP).(*layers.ARP)
 
 	if arpRequest.Operation == layers.ARPRequest {
-		if lease, found := h.acquiredIPs[net.IP(arpRequest.DstProtAddress).String()]; found {
+
+		h.acquiredIPsMutex.Lock()
+		lease, found := h.acquiredIPs[net.IP(arpRequest.DstProtAddress).String()]
+		h.acquiredIPsMutex.Unlock()
+
+		if found {
 
 			goPacketSerializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 
@@ -0,0 +1,617 @@
+package handler
+
+import (
+	"dhammer/config"
+	"dhammer/message"
+	"dhammer/socketeer"
+	"dhammer/stats"
+	"dhammer/xid"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the sweep goroutine walks the xid tracker
+// looking for DISCOVER/OFFER transactions that never got a follow-up
+// REQUEST, mirroring HandlerDhcpV4's renewLoop.
+const sweepInterval = 1 * time.Second
+
+const defaultOfferTimeout = 5 * time.Second
+
+// cachedReply is a previously-sent REQUEST reply, kept around so an
+// idempotent retransmit resends the same message type it originally got
+// instead of always assuming an ACK.
+type cachedReply struct {
+	buf     []byte
+	msgType layers.DHCPMsgType
+}
+
+// ServerLeaseDhcpV4 tracks a single address handed out by HandlerDhcpV4Server,
+// keyed by the client's hardware address.
+type ServerLeaseDhcpV4 struct {
+	IP       net.IP
+	HwAddr   net.HardwareAddr
+	Xid      uint32
+	Bound    bool
+	Expiry   time.Time
+	LastSent []byte
+}
+
+// dhcpV4Pool hands out sequential addresses out of a CIDR range, skipping the
+// network and broadcast addresses and recycling released leases.
+type dhcpV4Pool struct {
+	network   *net.IPNet
+	cursor    net.IP
+	released  []net.IP
+	allocated map[string]bool
+}
+
+func newDhcpV4Pool(cidr string) (*dhcpV4Pool, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dhcpV4Pool{
+		network:   network,
+		cursor:    ip.Mask(network.Mask),
+		allocated: make(map[string]bool),
+	}, nil
+}
+
+func incIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
+
+func isBroadcast(ip net.IP, network *net.IPNet) bool {
+	broadcast := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		broadcast[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip.Equal(broadcast)
+}
+
+func (p *dhcpV4Pool) allocate() (net.IP, error) {
+	if n := len(p.released); n > 0 {
+		ip := p.released[n-1]
+		p.released = p.released[:n-1]
+		p.allocated[ip.String()] = true
+		return ip, nil
+	}
+
+	for {
+		p.cursor = incIP(p.cursor)
+
+		if !p.network.Contains(p.cursor) {
+			return nil, errors.New("dhcpv4-server: address pool exhausted")
+		}
+
+		if isBroadcast(p.cursor, p.network) {
+			continue
+		}
+
+		if !p.allocated[p.cursor.String()] {
+			p.allocated[p.cursor.String()] = true
+			return p.cursor, nil
+		}
+	}
+}
+
+func (p *dhcpV4Pool) release(ip net.IP) {
+	if _, found := p.allocated[ip.String()]; found {
+		delete(p.allocated, ip.String())
+		p.released = append(p.released, ip)
+	}
+}
+
+type HandlerDhcpV4Server struct {
+	options         *config.DhcpV4ServerOptions
+	socketeer       *socketeer.RawSocketeer
+	iface           *net.Interface
+	pool            *dhcpV4Pool
+	leasesByMac     map[string]*ServerLeaseDhcpV4
+	leasesByMacMux  sync.Mutex
+	repliesByXid    map[uint32]cachedReply
+	repliesByXidMux sync.Mutex
+	addLog          func(string) bool
+	addError        func(error) bool
+	sendPayload     func([]byte) bool
+	addStat         func(stats.StatValue) bool
+	inputChannel    chan message.Message
+	doneChannel     chan struct{}
+
+	xidTracker       *xid.Tracker
+	offerTimeout     time.Duration
+	sweepStopChannel chan struct{}
+	sweepDoneChannel chan struct{}
+
+	observers []LeaseObserver
+}
+
+func init() {
+	if err := AddHandler("dhcpv4-server", NewDhcpV4Server); err != nil {
+		panic(err)
+	}
+}
+
+func NewDhcpV4Server(hip HandlerInitParams) Handler {
+
+	h := HandlerDhcpV4Server{
+		options:          hip.options.(*config.DhcpV4ServerOptions),
+		socketeer:        hip.socketeer,
+		iface:            hip.socketeer.IfInfo,
+		leasesByMac:      make(map[string]*ServerLeaseDhcpV4),
+		repliesByXid:     make(map[uint32]cachedReply),
+		addLog:           hip.logFunc,
+		addError:         hip.errFunc,
+		sendPayload:      hip.socketeer.AddPayload,
+		addStat:          hip.statFunc,
+		inputChannel:     make(chan message.Message, 10000),
+		doneChannel:      make(chan struct{}),
+		xidTracker:       xid.NewTracker(),
+		sweepStopChannel: make(chan struct{}),
+		sweepDoneChannel: make(chan struct{}),
+		observers:        hip.observers,
+	}
+
+	h.offerTimeout = defaultOfferTimeout
+	if h.options.OfferTimeoutSeconds > 0 {
+		h.offerTimeout = time.Duration(h.options.OfferTimeoutSeconds) * time.Second
+	}
+
+	return &h
+}
+
+func (h *HandlerDhcpV4Server) ReceiveMessage(msg message.Message) bool {
+
+	select {
+	case h.inputChannel <- msg:
+		return true
+	default:
+	}
+
+	return false
+
+}
+
+func (h *HandlerDhcpV4Server) Init() error {
+	pool, err := newDhcpV4Pool(h.options.PoolCIDR)
+	if err != nil {
+		return err
+	}
+
+	h.pool = pool
+
+	go h.sweepLoop()
+
+	return nil
+}
+
+func (h *HandlerDhcpV4Server) DeInit() error {
+	return nil
+}
+
+func (h *HandlerDhcpV4Server) Stop() error {
+	close(h.inputChannel)
+	<-h.doneChannel
+
+	close(h.sweepStopChannel)
+	<-h.sweepDoneChannel
+
+	return nil
+}
+
+// sweepLoop periodically reaps DISCOVER/OFFER transactions that never saw a
+// follow-up REQUEST, releasing their reserved address back to the pool.
+func (h *HandlerDhcpV4Server) sweepLoop() {
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.sweepStopChannel:
+			h.sweepDoneChannel <- struct{}{}
+			return
+		case now := <-ticker.C:
+			h.reapExpiredOffers(now)
+			h.reapExpiredLeases(now)
+		}
+	}
+}
+
+// reapExpiredOffers walks the xid tracker for offers whose client never sent
+// a REQUEST within offerTimeout and returns their reserved address to the
+// pool so it can be handed out again.
+func (h *HandlerDhcpV4Server) reapExpiredOffers(now time.Time) {
+
+	_, abandoned := h.xidTracker.Expired(now)
+
+	for _, txn := range abandoned {
+		h.addStat(stats.OfferTimeoutStat)
+
+		h.leasesByMacMux.Lock()
+
+		macStr := txn.HwAddr.String()
+		if lease, found := h.leasesByMac[macStr]; found && !lease.Bound {
+			h.pool.release(lease.IP)
+			delete(h.leasesByMac, macStr)
+			h.deleteCachedReply(lease.Xid)
+		}
+
+		h.leasesByMacMux.Unlock()
+	}
+}
+
+// reapExpiredLeases recycles bound leases once their Expiry has passed
+// without a renewal, so the pool doesn't just grow for the lifetime of a
+// long-running stress test.
+func (h *HandlerDhcpV4Server) reapExpiredLeases(now time.Time) {
+
+	h.leasesByMacMux.Lock()
+	defer h.leasesByMacMux.Unlock()
+
+	for macStr, lease := range h.leasesByMac {
+		if lease.Bound && now.After(lease.Expiry) {
+			h.addStat(stats.ServerLeaseExpiredStat)
+			h.pool.release(lease.IP)
+			delete(h.leasesByMac, macStr)
+			h.deleteCachedReply(lease.Xid)
+		}
+	}
+}
+
+// handleRelease recycles the address a client held for macStr back into the
+// pool, whether it arrived as a DHCPRELEASE (giving up a bound lease) or a
+// DHCPDECLINE (rejecting an offered/assigned address as already in use).
+func (h *HandlerDhcpV4Server) handleRelease(request *layers.DHCPv4) {
+
+	macStr := request.ClientHWAddr.String()
+
+	h.leasesByMacMux.Lock()
+
+	lease, found := h.leasesByMac[macStr]
+	if !found {
+		h.leasesByMacMux.Unlock()
+		return
+	}
+
+	h.pool.release(lease.IP)
+	delete(h.leasesByMac, macStr)
+	h.deleteCachedReply(lease.Xid)
+
+	h.leasesByMacMux.Unlock()
+
+	notifyObservers(h.observers, LeaseEvent{
+		Type:   LeaseReleased,
+		Time:   time.Now(),
+		Xid:    lease.Xid,
+		HwAddr: lease.HwAddr,
+		IP:     lease.IP,
+	})
+}
+
+// deleteCachedReply evicts a REQUEST's cached reply once its lease has been
+// recycled. Cached NAKs belong to no lease and are not evicted.
+func (h *HandlerDhcpV4Server) deleteCachedReply(xid uint32) {
+	h.repliesByXidMux.Lock()
+	delete(h.repliesByXid, xid)
+	h.repliesByXidMux.Unlock()
+}
+
+func (h *HandlerDhcpV4Server) Run() {
+
+	var msg message.Message
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       h.iface.HardwareAddr,
+		EthernetType: layers.EthernetTypeIPv4,
+		Length:       0,
+	}
+
+	ipLayer := &layers.IPv4{
+		Version:  4, // IPv4
+		TTL:      64,
+		Protocol: 17, // UDP
+		SrcIP:    h.options.ServerIdentifier,
+	}
+
+	udpLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(67),
+		DstPort: layers.UDPPort(68),
+	}
+
+	goPacketSerializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	for msg = range h.inputChannel {
+
+		if msg.Packet.Layer(layers.LayerTypeDHCPv4) == nil {
+			continue
+		}
+
+		request := msg.Packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+
+		var reqOptions [256]layers.DHCPOption
+
+		for _, option := range request.Options {
+			reqOptions[option.Type] = option
+		}
+
+		if len(reqOptions[layers.DHCPOptMessageType].Data) == 0 {
+			// Malformed packet from a non-conformant client/relay under
+			// test - no message type to dispatch on, drop it.
+			continue
+		}
+
+		msgType := reqOptions[layers.DHCPOptMessageType].Data[0]
+
+		requestEtherFrame := msg.Packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+
+		switch msgType {
+		case (byte)(layers.DHCPMsgTypeDiscover):
+
+			h.addStat(stats.DiscoverReceivedStat)
+			h.handleDiscover(request, requestEtherFrame, ethernetLayer, ipLayer, udpLayer, goPacketSerializeOpts)
+
+		case (byte)(layers.DHCPMsgTypeRequest):
+
+			h.addStat(stats.RequestReceivedStat)
+			h.handleRequest(request, requestEtherFrame, ethernetLayer, ipLayer, udpLayer, goPacketSerializeOpts)
+
+		case (byte)(layers.DHCPMsgTypeRelease):
+
+			h.addStat(stats.ReleaseReceivedStat)
+			h.handleRelease(request)
+
+		case (byte)(layers.DHCPMsgTypeDecline):
+
+			h.addStat(stats.DeclineReceivedStat)
+			h.handleRelease(request)
+		}
+	}
+
+	h.doneChannel <- struct{}{}
+}
+
+func (h *HandlerDhcpV4Server) handleDiscover(request *layers.DHCPv4, requestEtherFrame *layers.Ethernet, ethernetLayer *layers.Ethernet, ipLayer *layers.IPv4, udpLayer *layers.UDP, opts gopacket.SerializeOptions) {
+
+	macStr := request.ClientHWAddr.String()
+
+	h.leasesByMacMux.Lock()
+
+	lease, found := h.leasesByMac[macStr]
+	if !found {
+		ip, err := h.pool.allocate()
+		if err != nil {
+			h.leasesByMacMux.Unlock()
+			h.addError(err)
+			return
+		}
+
+		lease = &ServerLeaseDhcpV4{IP: ip, HwAddr: request.ClientHWAddr}
+		h.leasesByMac[macStr] = lease
+	}
+
+	lease.Xid = request.Xid
+
+	h.leasesByMacMux.Unlock()
+
+	buf := h.buildReply(request, requestEtherFrame, ethernetLayer, ipLayer, udpLayer, opts, layers.DHCPMsgTypeOffer, lease.IP)
+
+	if buf != nil {
+		lease.LastSent = buf
+
+		if h.sendPayload(buf) {
+			h.addStat(stats.OfferSentStat)
+
+			// Give the client offerTimeout to follow up with a REQUEST
+			// before reapExpiredOffers reclaims the reserved address.
+			h.xidTracker.Track(request.Xid, request.ClientHWAddr, h.offerTimeout, 0)
+
+			notifyObservers(h.observers, LeaseEvent{
+				Type:   LeaseOffered,
+				Time:   time.Now(),
+				Xid:    request.Xid,
+				HwAddr: lease.HwAddr,
+				IP:     lease.IP,
+			})
+		}
+	}
+}
+
+func (h *HandlerDhcpV4Server) handleRequest(request *layers.DHCPv4, requestEtherFrame *layers.Ethernet, ethernetLayer *layers.Ethernet, ipLayer *layers.IPv4, udpLayer *layers.UDP, opts gopacket.SerializeOptions) {
+
+	h.repliesByXidMux.Lock()
+	cached, found := h.repliesByXid[request.Xid]
+	h.repliesByXidMux.Unlock()
+
+	if found {
+		// Idempotent retransmit of a REQUEST we've already answered - note
+		// this is keyed separately from the DISCOVER/OFFER exchange, since
+		// RFC 2131 clients reuse the same xid for the whole transaction and
+		// the REQUEST needs its own ACK/NAK, not the cached OFFER.
+		if h.sendPayload(cached.buf) {
+			if cached.msgType == layers.DHCPMsgTypeNak {
+				h.addStat(stats.NakSentStat)
+			} else {
+				h.addStat(stats.AckSentStat)
+			}
+		}
+		return
+	}
+
+	macStr := request.ClientHWAddr.String()
+
+	// The DISCOVER/OFFER transaction is done, whether this REQUEST confirms
+	// it or not - stop the sweep from reclaiming it out from under us.
+	h.xidTracker.Resolve(request.Xid)
+
+	h.leasesByMacMux.Lock()
+	lease, found := h.leasesByMac[macStr]
+
+	if !found || !lease.IP.Equal(requestedIP(request)) {
+		h.leasesByMacMux.Unlock()
+
+		buf := h.buildNak(request, requestEtherFrame, ethernetLayer, ipLayer, udpLayer, opts)
+		if buf != nil {
+			h.repliesByXidMux.Lock()
+			h.repliesByXid[request.Xid] = cachedReply{buf: buf, msgType: layers.DHCPMsgTypeNak}
+			h.repliesByXidMux.Unlock()
+
+			if h.sendPayload(buf) {
+				h.addStat(stats.NakSentStat)
+
+				notifyObservers(h.observers, LeaseEvent{
+					Type:   LeaseNacked,
+					Time:   time.Now(),
+					Xid:    request.Xid,
+					HwAddr: request.ClientHWAddr,
+				})
+			}
+		}
+		return
+	}
+
+	lease.Xid = request.Xid
+	lease.Bound = true
+	lease.Expiry = time.Now().Add(time.Duration(h.options.LeaseSeconds) * time.Second)
+
+	h.leasesByMacMux.Unlock()
+
+	buf := h.buildReply(request, requestEtherFrame, ethernetLayer, ipLayer, udpLayer, opts, layers.DHCPMsgTypeAck, lease.IP)
+
+	if buf != nil {
+		lease.LastSent = buf
+
+		h.repliesByXidMux.Lock()
+		h.repliesByXid[request.Xid] = cachedReply{buf: buf, msgType: layers.DHCPMsgTypeAck}
+		h.repliesByXidMux.Unlock()
+
+		if h.sendPayload(buf) {
+			h.addStat(stats.AckSentStat)
+
+			notifyObservers(h.observers, LeaseEvent{
+				Type:       LeaseAcknowledged,
+				Time:       time.Now(),
+				Xid:        lease.Xid,
+				HwAddr:     lease.HwAddr,
+				IP:         lease.IP,
+				ServerID:   h.options.ServerIdentifier,
+				SubnetMask: h.options.SubnetMask,
+				Router:     h.options.Router,
+				DNS:        h.options.DNSServers,
+				LeaseTime:  time.Duration(h.options.LeaseSeconds) * time.Second,
+			})
+		}
+	}
+}
+
+func requestedIP(request *layers.DHCPv4) net.IP {
+	for _, option := range request.Options {
+		if option.Type == layers.DHCPOptRequestIP {
+			return net.IP(option.Data)
+		}
+	}
+	return request.ClientIP
+}
+
+func (h *HandlerDhcpV4Server) buildReply(request *layers.DHCPv4, requestEtherFrame, ethernetLayer *layers.Ethernet, ipLayer *layers.IPv4, udpLayer *layers.UDP, opts gopacket.SerializeOptions, msgType layers.DHCPMsgType, yourIP net.IP) []byte {
+
+	replyEthernetLayer := &layers.Ethernet{
+		SrcMAC:       ethernetLayer.SrcMAC,
+		DstMAC:       requestEtherFrame.SrcMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	replyIPLayer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: 17,
+		SrcIP:    h.options.ServerIdentifier,
+		DstIP:    net.IPv4bcast,
+	}
+
+	replyUDPLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(67),
+		DstPort: layers.UDPPort(68),
+	}
+
+	if !request.RelayAgentIP.Equal(net.IPv4zero) && request.RelayAgentIP != nil {
+		// Behind a relay: unicast the reply back to the giaddr on the BOOTPS port.
+		replyIPLayer.DstIP = request.RelayAgentIP
+		replyUDPLayer.DstPort = layers.UDPPort(67)
+	}
+
+	replyLayer := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          request.Xid,
+		YourClientIP: yourIP,
+		RelayAgentIP: request.RelayAgentIP,
+		ClientHWAddr: request.ClientHWAddr,
+		Flags:        request.Flags,
+	}
+
+	replyLayer.Options = make(layers.DHCPOptions, 0, 7)
+	replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}))
+	replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptServerID, h.options.ServerIdentifier.To4()))
+
+	// RFC 2131 §4.3.2: a DHCPNAK MUST NOT carry any configuration
+	// parameters beyond the message type and server identifier.
+	if msgType != layers.DHCPMsgTypeNak {
+		replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptSubnetMask, h.options.SubnetMask.To4()))
+		replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptLeaseTime, uint32ToBytes(uint32(h.options.LeaseSeconds))))
+
+		if h.options.Router != nil {
+			replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptRouter, h.options.Router.To4()))
+		}
+
+		if len(h.options.DNSServers) > 0 {
+			var dns []byte
+			for _, ip := range h.options.DNSServers {
+				dns = append(dns, ip.To4()...)
+			}
+			replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptDNS, dns))
+		}
+	}
+
+	replyLayer.Options = append(replyLayer.Options, layers.NewDHCPOption(layers.DHCPOptEnd, []byte{}))
+
+	replyUDPLayer.SetNetworkLayerForChecksum(replyIPLayer)
+
+	buf := gopacket.NewSerializeBuffer()
+
+	if err := gopacket.SerializeLayers(buf, opts,
+		replyEthernetLayer,
+		replyIPLayer,
+		replyUDPLayer,
+		replyLayer,
+	); err != nil {
+		h.addError(err)
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+func (h *HandlerDhcpV4Server) buildNak(request *layers.DHCPv4, requestEtherFrame, ethernetLayer *layers.Ethernet, ipLayer *layers.IPv4, udpLayer *layers.UDP, opts gopacket.SerializeOptions) []byte {
+	return h.buildReply(request, requestEtherFrame, ethernetLayer, ipLayer, udpLayer, opts, layers.DHCPMsgTypeNak, net.IPv4zero)
+}
+
+func uint32ToBytes(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
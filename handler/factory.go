@@ -22,6 +22,7 @@ type HandlerInitParams struct {
 	logFunc   func(string) bool
 	errFunc   func(error) bool
 	statFunc  func(stats.StatValue) bool
+	observers []LeaseObserver
 }
 
 var handlers map[string]func(HandlerInitParams) Handler = make(map[string]func(HandlerInitParams) Handler)
@@ -36,13 +37,14 @@ func AddHandler(s string, f func(HandlerInitParams) Handler) error {
 	return nil
 }
 
-func New(s *socketeer.RawSocketeer, o config.HammerConfig, logFunc func(string) bool, errFunc func(error) bool, statFunc func(stats.StatValue) bool) (Handler, error) {
+func New(s *socketeer.RawSocketeer, o config.HammerConfig, logFunc func(string) bool, errFunc func(error) bool, statFunc func(stats.StatValue) bool, observers []LeaseObserver) (Handler, error) {
 	hip := HandlerInitParams{
 		options:   o,
 		socketeer: s,
 		logFunc:   logFunc,
 		errFunc:   errFunc,
 		statFunc:  statFunc,
+		observers: observers,
 	}
 
 	hf, ok := handlers[o.HammerType()]
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net"
+	"time"
+)
+
+// LeaseEventType identifies which DHCP state transition a LeaseEvent
+// describes.
+type LeaseEventType int
+
+const (
+	LeaseOffered LeaseEventType = iota
+	LeaseAcknowledged
+	LeaseNacked
+	LeaseReleased
+	LeaseExpired
+)
+
+func (t LeaseEventType) String() string {
+	switch t {
+	case LeaseOffered:
+		return "offered"
+	case LeaseAcknowledged:
+		return "acknowledged"
+	case LeaseNacked:
+		return "nacked"
+	case LeaseReleased:
+		return "released"
+	case LeaseExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// LeaseEvent is the structured record handed to every LeaseObserver callback.
+// Fields that don't apply to a given Type (e.g. SubnetMask on a NAK) are left
+// at their zero value.
+type LeaseEvent struct {
+	Type       LeaseEventType
+	Time       time.Time
+	Xid        uint32
+	HwAddr     net.HardwareAddr
+	IP         net.IP
+	ServerID   net.IP
+	SubnetMask net.IP
+	Router     net.IP
+	DNS        []net.IP
+	LeaseTime  time.Duration
+}
+
+// LeaseObserver is notified of every lease state transition a handler makes.
+// It's registered through HandlerInitParams rather than being specific to
+// HandlerDhcpV4, so the same sinks can be reused by HandlerDhcpV4Server today
+// and by a future DHCPv6 handler without new plumbing.
+type LeaseObserver interface {
+	OnOffer(LeaseEvent)
+	OnAck(LeaseEvent)
+	OnNak(LeaseEvent)
+	OnRelease(LeaseEvent)
+	OnExpire(LeaseEvent)
+}
+
+// notifyObservers dispatches ev to every observer in observers, in
+// registration order. A nil or empty slice is a no-op.
+func notifyObservers(observers []LeaseObserver, ev LeaseEvent) {
+	for _, o := range observers {
+		switch ev.Type {
+		case LeaseOffered:
+			o.OnOffer(ev)
+		case LeaseAcknowledged:
+			o.OnAck(ev)
+		case LeaseNacked:
+			o.OnNak(ev)
+		case LeaseReleased:
+			o.OnRelease(ev)
+		case LeaseExpired:
+			o.OnExpire(ev)
+		}
+	}
+}
+
+// ipString renders ip as a string, or "" for a nil/unset address - used by
+// the built-in observers so optional fields don't show up as "<nil>".
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// LeaseEventMessage is the wire representation of a LeaseEvent streamed by
+// GRPCLeaseObserver. dhammer doesn't otherwise depend on protoc, so this is
+// a small hand-maintained message rather than protoc-gen-go output; it only
+// needs to satisfy the legacy proto.Message interface that grpc's default
+// codec expects.
+type LeaseEventMessage struct {
+	Event        string   `protobuf:"bytes,1,opt,name=event"`
+	UnixNano     int64    `protobuf:"varint,2,opt,name=unix_nano"`
+	Xid          uint32   `protobuf:"varint,3,opt,name=xid"`
+	HwAddr       string   `protobuf:"bytes,4,opt,name=hw_addr"`
+	IP           string   `protobuf:"bytes,5,opt,name=ip"`
+	ServerID     string   `protobuf:"bytes,6,opt,name=server_id"`
+	SubnetMask   string   `protobuf:"bytes,7,opt,name=subnet_mask"`
+	Router       string   `protobuf:"bytes,8,opt,name=router"`
+	DNS          []string `protobuf:"bytes,9,rep,name=dns"`
+	LeaseSeconds int64    `protobuf:"varint,10,opt,name=lease_seconds"`
+}
+
+func (m *LeaseEventMessage) Reset()         { *m = LeaseEventMessage{} }
+func (m *LeaseEventMessage) String() string { return m.Event }
+func (*LeaseEventMessage) ProtoMessage()    {}
+
+type subscribeRequest struct{}
+
+func (m *subscribeRequest) Reset()         { *m = subscribeRequest{} }
+func (m *subscribeRequest) String() string { return "" }
+func (*subscribeRequest) ProtoMessage()    {}
+
+// leaseEventsServer is the interface the hand-rolled service descriptor
+// below dispatches to - the equivalent of what protoc-gen-go-grpc would
+// generate for a service with a single server-streaming Subscribe RPC.
+type leaseEventsServer interface {
+	Subscribe(*subscribeRequest, leaseEvents_SubscribeServer) error
+}
+
+// leaseEvents_SubscribeServer is the server side of the Subscribe stream.
+type leaseEvents_SubscribeServer interface {
+	Send(*LeaseEventMessage) error
+	grpc.ServerStream
+}
+
+type leaseEventsSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (s *leaseEventsSubscribeServer) Send(m *LeaseEventMessage) error {
+	return s.ServerStream.SendMsg(m)
+}
+
+func leaseEventsSubscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(leaseEventsServer).Subscribe(new(subscribeRequest), &leaseEventsSubscribeServer{stream})
+}
+
+var leaseEventsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dhammer.LeaseEvents",
+	HandlerType: (*leaseEventsServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       leaseEventsSubscribeHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// GRPCLeaseObserver runs a gRPC server exposing a single server-streaming
+// Subscribe RPC: every client that connects receives each LeaseEvent as it
+// happens, for as long as its stream stays open. A subscriber whose 64-event
+// buffer is full misses the events published while it stays full.
+type GRPCLeaseObserver struct {
+	server   *grpc.Server
+	listener net.Listener
+	addError func(error) bool
+
+	mu          sync.Mutex
+	subscribers map[chan *LeaseEventMessage]struct{}
+}
+
+// NewGRPCLeaseObserver starts a gRPC server listening on addr and returns an
+// observer that streams lease events to whatever subscribes.
+func NewGRPCLeaseObserver(addr string, addError func(error) bool) (*GRPCLeaseObserver, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &GRPCLeaseObserver{
+		server:      grpc.NewServer(),
+		listener:    listener,
+		addError:    addError,
+		subscribers: make(map[chan *LeaseEventMessage]struct{}),
+	}
+
+	o.server.RegisterService(&leaseEventsServiceDesc, o)
+
+	go func() {
+		if err := o.server.Serve(listener); err != nil {
+			o.addError(err)
+		}
+	}()
+
+	return o, nil
+}
+
+// Subscribe implements leaseEventsServer: it registers a channel for the
+// lifetime of the RPC and relays the events published to it until the
+// client disconnects.
+func (o *GRPCLeaseObserver) Subscribe(_ *subscribeRequest, stream leaseEvents_SubscribeServer) error {
+	ch := make(chan *LeaseEventMessage, 64)
+
+	o.mu.Lock()
+	o.subscribers[ch] = struct{}{}
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		delete(o.subscribers, ch)
+		o.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case msg := <-ch:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (o *GRPCLeaseObserver) publish(ev LeaseEvent, eventName string) {
+	msg := &LeaseEventMessage{
+		Event:        eventName,
+		UnixNano:     ev.Time.UnixNano(),
+		Xid:          ev.Xid,
+		IP:           ipString(ev.IP),
+		ServerID:     ipString(ev.ServerID),
+		SubnetMask:   ipString(ev.SubnetMask),
+		Router:       ipString(ev.Router),
+		LeaseSeconds: int64(ev.LeaseTime / time.Second),
+	}
+
+	if ev.HwAddr != nil {
+		msg.HwAddr = ev.HwAddr.String()
+	}
+
+	for _, ip := range ev.DNS {
+		msg.DNS = append(msg.DNS, ip.String())
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for ch := range o.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			// Slow subscriber; drop the event rather than block publishing.
+		}
+	}
+}
+
+func (o *GRPCLeaseObserver) OnOffer(ev LeaseEvent)   { o.publish(ev, "offered") }
+func (o *GRPCLeaseObserver) OnAck(ev LeaseEvent)     { o.publish(ev, "acknowledged") }
+func (o *GRPCLeaseObserver) OnNak(ev LeaseEvent)     { o.publish(ev, "nacked") }
+func (o *GRPCLeaseObserver) OnRelease(ev LeaseEvent) { o.publish(ev, "released") }
+func (o *GRPCLeaseObserver) OnExpire(ev LeaseEvent)  { o.publish(ev, "expired") }
+
+// Stop gracefully shuts down the gRPC server.
+func (o *GRPCLeaseObserver) Stop() error {
+	o.server.GracefulStop()
+	return nil
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaseEventRecord is the on-disk shape of a LeaseEvent: the same fields,
+// with the event type rendered as its string name rather than the
+// LeaseEventType int, and IPs rendered as strings so the file stays
+// human-readable.
+type leaseEventRecord struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Xid        uint32    `json:"xid"`
+	HwAddr     string    `json:"hw_addr,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	ServerID   string    `json:"server_id,omitempty"`
+	SubnetMask string    `json:"subnet_mask,omitempty"`
+	Router     string    `json:"router,omitempty"`
+	DNS        []string  `json:"dns,omitempty"`
+	LeaseTime  string    `json:"lease_time,omitempty"`
+}
+
+func newLeaseEventRecord(ev LeaseEvent) leaseEventRecord {
+	rec := leaseEventRecord{
+		Event:      ev.Type.String(),
+		Time:       ev.Time,
+		Xid:        ev.Xid,
+		IP:         ipString(ev.IP),
+		ServerID:   ipString(ev.ServerID),
+		SubnetMask: ipString(ev.SubnetMask),
+		Router:     ipString(ev.Router),
+	}
+
+	if ev.HwAddr != nil {
+		rec.HwAddr = ev.HwAddr.String()
+	}
+
+	if ev.LeaseTime > 0 {
+		rec.LeaseTime = ev.LeaseTime.String()
+	}
+
+	for _, ip := range ev.DNS {
+		rec.DNS = append(rec.DNS, ip.String())
+	}
+
+	return rec
+}
+
+// JSONFileObserver appends each LeaseEvent to a file as newline-delimited
+// JSON, one object per line, for tailing or feeding into a log pipeline.
+type JSONFileObserver struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewJSONFileObserver opens path for appending (creating it if necessary)
+// and returns an observer that writes every lease event to it.
+func NewJSONFileObserver(path string) (*JSONFileObserver, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONFileObserver{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (o *JSONFileObserver) write(ev LeaseEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_ = o.enc.Encode(newLeaseEventRecord(ev))
+}
+
+func (o *JSONFileObserver) OnOffer(ev LeaseEvent)   { o.write(ev) }
+func (o *JSONFileObserver) OnAck(ev LeaseEvent)     { o.write(ev) }
+func (o *JSONFileObserver) OnNak(ev LeaseEvent)     { o.write(ev) }
+func (o *JSONFileObserver) OnRelease(ev LeaseEvent) { o.write(ev) }
+func (o *JSONFileObserver) OnExpire(ev LeaseEvent)  { o.write(ev) }
+
+// Close closes the underlying file.
+func (o *JSONFileObserver) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.f.Close()
+}
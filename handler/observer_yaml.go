@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlLeaseSnapshot is one entry in a YAMLSnapshotObserver's periodic dump.
+type yamlLeaseSnapshot struct {
+	HwAddr     string    `yaml:"hw_addr"`
+	IP         string    `yaml:"ip"`
+	ServerID   string    `yaml:"server_id,omitempty"`
+	SubnetMask string    `yaml:"subnet_mask,omitempty"`
+	Router     string    `yaml:"router,omitempty"`
+	DNS        []string  `yaml:"dns,omitempty"`
+	Acquired   time.Time `yaml:"acquired"`
+}
+
+// YAMLSnapshotObserver keeps its own view of currently-held leases, built up
+// from OnAck/OnRelease/OnExpire events, and periodically writes it out as a
+// YAML file: a point-in-time view of acquiredIPs that's easier to read by
+// hand than the ndjson event log from JSONFileObserver.
+type YAMLSnapshotObserver struct {
+	path     string
+	interval time.Duration
+	addError func(error) bool
+
+	mu     sync.Mutex
+	leases map[string]yamlLeaseSnapshot
+
+	stopChannel chan struct{}
+	doneChannel chan struct{}
+}
+
+// NewYAMLSnapshotObserver writes a YAML snapshot of held leases to path
+// every interval, the first one interval after creation, until Stop is called.
+func NewYAMLSnapshotObserver(path string, interval time.Duration, addError func(error) bool) *YAMLSnapshotObserver {
+	o := &YAMLSnapshotObserver{
+		path:        path,
+		interval:    interval,
+		addError:    addError,
+		leases:      make(map[string]yamlLeaseSnapshot),
+		stopChannel: make(chan struct{}),
+		doneChannel: make(chan struct{}),
+	}
+
+	go o.run()
+
+	return o
+}
+
+func (o *YAMLSnapshotObserver) run() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.stopChannel:
+			close(o.doneChannel)
+			return
+		case <-ticker.C:
+			if err := o.writeSnapshot(); err != nil {
+				o.addError(err)
+			}
+		}
+	}
+}
+
+func (o *YAMLSnapshotObserver) writeSnapshot() error {
+	o.mu.Lock()
+	out := make([]yamlLeaseSnapshot, 0, len(o.leases))
+	for _, lease := range o.leases {
+		out = append(out, lease)
+	}
+	o.mu.Unlock()
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(o.path, data, 0644)
+}
+
+func (o *YAMLSnapshotObserver) OnOffer(ev LeaseEvent) {}
+func (o *YAMLSnapshotObserver) OnNak(ev LeaseEvent)   {}
+
+func (o *YAMLSnapshotObserver) OnAck(ev LeaseEvent) {
+	dns := make([]string, 0, len(ev.DNS))
+	for _, ip := range ev.DNS {
+		dns = append(dns, ip.String())
+	}
+
+	snapshot := yamlLeaseSnapshot{
+		IP:         ipString(ev.IP),
+		ServerID:   ipString(ev.ServerID),
+		SubnetMask: ipString(ev.SubnetMask),
+		Router:     ipString(ev.Router),
+		DNS:        dns,
+		Acquired:   ev.Time,
+	}
+
+	if ev.HwAddr != nil {
+		snapshot.HwAddr = ev.HwAddr.String()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.leases[snapshot.HwAddr] = snapshot
+}
+
+func (o *YAMLSnapshotObserver) OnRelease(ev LeaseEvent) { o.forget(ev) }
+func (o *YAMLSnapshotObserver) OnExpire(ev LeaseEvent)  { o.forget(ev) }
+
+func (o *YAMLSnapshotObserver) forget(ev LeaseEvent) {
+	if ev.HwAddr == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.leases, ev.HwAddr.String())
+}
+
+// Stop ends the snapshot goroutine and writes one final snapshot so the file
+// reflects the state at shutdown.
+func (o *YAMLSnapshotObserver) Stop() error {
+	close(o.stopChannel)
+	<-o.doneChannel
+
+	return o.writeSnapshot()
+}
@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"dhammer/config"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	DiscoverReceivedStat = iota
+	RequestReceivedStat
+	ReleaseReceivedStat
+	DeclineReceivedStat
+
+	OfferSentStat
+	AckSentStat
+	NakSentStat
+
+	OfferTimeoutStat
+	ServerLeaseExpiredStat
+)
+
+type StatsV4Server struct {
+	options *config.DhcpV4ServerOptions
+
+	countersMux *sync.RWMutex
+	counters    [9]Stat
+
+	addLog   func(string) bool
+	addError func(error) bool
+
+	statChannel chan StatValue
+	doneChannel chan struct{}
+}
+
+func init() {
+	if err := AddStatter("dhcpv4-server", NewStatsDhcpV4Server); err != nil {
+		panic(err)
+	}
+}
+
+func NewStatsDhcpV4Server(sip StatsInitParams) Stats {
+	s := StatsV4Server{
+		options:     sip.options.(*config.DhcpV4ServerOptions),
+		addLog:      sip.logFunc,
+		addError:    sip.errFunc,
+		statChannel: make(chan StatValue, 10000),
+		doneChannel: make(chan struct{}, 1),
+		countersMux: &sync.RWMutex{},
+	}
+
+	return &s
+}
+
+func (s *StatsV4Server) AddStat(sv StatValue) bool {
+	select {
+	case s.statChannel <- sv:
+		return true
+	default:
+	}
+	return false
+}
+
+func (s *StatsV4Server) Init() error {
+
+	s.counters[0].Name = "DiscoverReceived"
+	s.counters[1].Name = "RequestReceived"
+	s.counters[2].Name = "ReleaseReceived"
+	s.counters[3].Name = "DeclineReceived"
+
+	s.counters[4].Name = "OfferSent"
+	s.counters[5].Name = "AckSent"
+	s.counters[6].Name = "NakSent"
+
+	s.counters[7].Name = "OfferTimeout"
+	s.counters[8].Name = "LeaseExpired"
+
+	return nil
+}
+
+func (s *StatsV4Server) DeInit() error {
+	return nil
+}
+
+func (s *StatsV4Server) Run() {
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	stopTicker := make(chan struct{})
+
+	ticker := time.NewTicker(time.Duration(s.options.StatsRate) * time.Second)
+	go func() {
+		for {
+			select {
+			case <-stopTicker:
+				ticker.Stop()
+				wg.Done()
+				return
+			case <-ticker.C:
+			}
+
+			if err := s.calculateStats(); err != nil {
+				s.addError(err)
+			}
+		}
+	}()
+
+	for sv := range s.statChannel {
+		s.countersMux.Lock()
+		s.counters[sv].Value++
+		s.countersMux.Unlock()
+	}
+
+	stopTicker <- struct{}{}
+	wg.Wait()
+
+	close(s.doneChannel)
+}
+
+func (s *StatsV4Server) calculateStats() error {
+
+	var StatsTickerRate float64 = float64(s.options.StatsRate)
+
+	s.countersMux.Lock()
+	for i := 0; i < len(s.counters); i++ {
+		s.counters[i].RatePerSecond = float64((s.counters[i].Value - s.counters[i].PreviousTickerValue)) / StatsTickerRate
+		s.counters[i].PreviousTickerValue = s.counters[i].Value
+	}
+	s.countersMux.Unlock()
+
+	return nil
+}
+
+func (s *StatsV4Server) String() string {
+
+	s.countersMux.RLock()
+	defer s.countersMux.RUnlock()
+
+	if jsonData, err := json.MarshalIndent(s.counters, "", "  "); err != nil {
+		s.addError(err)
+		return ""
+	} else {
+		return string(jsonData)
+	}
+}
+
+func (s *StatsV4Server) Stop() error {
+	close(s.statChannel)
+	_, _ = <-s.doneChannel
+
+	return nil
+}
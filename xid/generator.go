@@ -0,0 +1,39 @@
+// Package xid generates DHCP transaction ids and tracks the in-flight
+// exchanges they belong to, for reuse by both the dhcpv4 client and server
+// handlers.
+package xid
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Generator produces DHCP transaction ids per RFC 2131 §4.1, which asks
+// clients to choose a new, reasonably random xid for each exchange. It's
+// seeded from the sending interface's hardware address combined with the
+// time the generator was created, so that concurrent dhammer processes
+// running against different interfaces don't converge on the same sequence.
+type Generator struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func NewGenerator(hwAddr net.HardwareAddr) *Generator {
+	h := fnv.New64a()
+	h.Write(hwAddr)
+
+	seed := int64(h.Sum64()) ^ time.Now().UnixNano()
+
+	return &Generator{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Next returns the next transaction id in the sequence.
+func (g *Generator) Next() uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.rnd.Uint32()
+}
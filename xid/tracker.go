@@ -0,0 +1,85 @@
+package xid
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Transaction is a single DHCP exchange a Tracker is waiting to see resolved,
+// keyed by its Xid.
+type Transaction struct {
+	Xid         uint32
+	HwAddr      net.HardwareAddr
+	Deadline    time.Time
+	Attempts    int
+	MaxAttempts int
+	baseTimeout time.Duration
+}
+
+// Tracker keys in-flight DHCP transactions by Xid, so a receive loop can
+// resolve them as replies arrive and time out and retry the rest.
+type Tracker struct {
+	mu      sync.Mutex
+	pending map[uint32]*Transaction
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{pending: make(map[uint32]*Transaction)}
+}
+
+// Track begins waiting on xid, due within timeout. Up to maxAttempts retries
+// are allowed before Expired reports the transaction as abandoned.
+func (t *Tracker) Track(xid uint32, hwAddr net.HardwareAddr, timeout time.Duration, maxAttempts int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[xid] = &Transaction{
+		Xid:         xid,
+		HwAddr:      hwAddr,
+		Deadline:    time.Now().Add(timeout),
+		MaxAttempts: maxAttempts,
+		baseTimeout: timeout,
+	}
+}
+
+// Resolve removes and returns the transaction for xid, if one was pending.
+func (t *Tracker) Resolve(xid uint32) (*Transaction, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	txn, found := t.pending[xid]
+	if found {
+		delete(t.pending, xid)
+	}
+
+	return txn, found
+}
+
+// Expired walks the pending set for transactions past their deadline. Those
+// still under MaxAttempts have their deadline pushed out with exponential
+// backoff and are returned in retry; the rest are removed and returned in
+// abandoned.
+func (t *Tracker) Expired(now time.Time) (retry []*Transaction, abandoned []*Transaction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for xid, txn := range t.pending {
+		if now.Before(txn.Deadline) {
+			continue
+		}
+
+		txn.Attempts++
+
+		if txn.Attempts > txn.MaxAttempts {
+			abandoned = append(abandoned, txn)
+			delete(t.pending, xid)
+			continue
+		}
+
+		txn.Deadline = now.Add(txn.baseTimeout * time.Duration(uint(1)<<uint(txn.Attempts)))
+		retry = append(retry, txn)
+	}
+
+	return retry, abandoned
+}